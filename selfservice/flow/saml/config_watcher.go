@@ -0,0 +1,49 @@
+package saml
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"time"
+)
+
+// defaultConfigWatchInterval is how often watchConfig polls config.Provider for changes
+// to the saml strategy's configuration, absent a push-based change-notification API on
+// config.Provider to subscribe to instead.
+const defaultConfigWatchInterval = 10 * time.Second
+
+// watchConfig polls the saml strategy's raw configuration and calls InvalidateAll on
+// manager whenever it changes, so that an operator rotating a provider's signing key,
+// certificate, or IdP metadata takes effect on the next request instead of requiring a
+// Kratos restart. onChange, if given, runs after InvalidateAll on every detected change,
+// e.g. to re-resolve the CSRF-exempt paths against a provider added or removed since the
+// last poll. It returns once ctx is done.
+func watchConfig(ctx context.Context, d managerDependencies, manager *MiddlewareManager, interval time.Duration, onChange ...func()) {
+	if interval <= 0 {
+		interval = defaultConfigWatchInterval
+	}
+
+	lastHash := configHash(ctx, d)
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if hash := configHash(ctx, d); !bytes.Equal(hash[:], lastHash[:]) {
+				lastHash = hash
+				manager.InvalidateAll()
+				for _, f := range onChange {
+					f()
+				}
+			}
+		}
+	}
+}
+
+func configHash(ctx context.Context, d managerDependencies) [32]byte {
+	return sha256.Sum256(d.Config(ctx).SelfServiceStrategy("saml").Config)
+}
@@ -1,15 +1,8 @@
 package saml
 
 import (
-	"bytes"
 	"context"
-	"crypto/rsa"
-	"crypto/tls"
-	"crypto/x509"
-	"encoding/pem"
-	"io/ioutil"
 	"net/http"
-	"net/url"
 	"strings"
 	"time"
 
@@ -21,32 +14,34 @@ import (
 	"github.com/ory/kratos/driver/config"
 	"github.com/ory/kratos/selfservice/errorx"
 
-	samlidp "github.com/crewjam/saml"
 	samlstrategy "github.com/ory/kratos/selfservice/strategy/saml"
 
 	"github.com/ory/kratos/session"
 	"github.com/ory/kratos/x"
 	"github.com/ory/x/decoderx"
-	"github.com/ory/x/jsonx"
 )
 
 const (
-	RouteSamlMetadata  = "/self-service/methods/saml/metadata"
-	RouteSamlLoginInit = "/self-service/methods/saml/browser" //Redirect to the IDP
-	RouteSamlAcs       = "/self-service/methods/saml/acs"
+	RouteSamlMetadata  = "/self-service/methods/saml/:provider/metadata"
+	RouteSamlLoginInit = "/self-service/methods/saml/:provider/browser" //Redirect to the IDP
+	RouteSamlAcs       = "/self-service/methods/saml/:provider/acs"
+	RouteSamlDiscovery = "/self-service/methods/saml/discovery"
 )
 
 var ErrNoSession = errors.New("saml: session not present")
-var samlMiddleware *samlsp.Middleware
+var ErrUnknownProvider = errors.New("saml: unknown provider")
 
 type (
 	handlerDependencies interface {
+		x.LoggingProvider
 		x.WriterProvider
 		x.CSRFProvider
 		session.ManagementProvider
 		session.PersistenceProvider
 		errorx.ManagementProvider
 		config.Provider
+		PersistenceProvider
+		MiddlewareManagerProvider
 	}
 	HandlerProvider interface {
 		LogoutHandler() *Handler
@@ -68,10 +63,24 @@ type CookieSessionProvider struct {
 }
 
 func NewHandler(d handlerDependencies) *Handler {
-	return &Handler{
+	h := &Handler{
 		d:  d,
 		dx: decoderx.NewHTTP(),
 	}
+
+	// There is no driver-level place to start these yet, so the handler starts them
+	// itself on construction: the config watcher (see watchConfig), and a background
+	// refresher that periodically re-fetches the IdP metadata of the providers configured
+	// at this point, building a provider's middleware first if it is not cached yet.
+	ctx := context.Background()
+	go watchConfig(ctx, d, d.SAMLMiddlewareManager(), 0, func() {
+		h.registerCSRFIgnorePaths(csrfExemptRoutes...)
+	})
+	if err := NewMetadataRefresher(d, d.SAMLMiddlewareManager()).Start(ctx); err != nil {
+		d.Logger().WithError(err).Error("Unable to start the SAML IdP metadata refresher; IdP metadata will not be kept up to date automatically.")
+	}
+
+	return h
 }
 
 // swagger:model selfServiceSamlUrl
@@ -89,23 +98,121 @@ type selfServiceSamlUrl struct {
 	SamlAcsURL string `json:"saml_acs_url"`
 }
 
+// csrfExemptRoutes lists the route templates that must never require a CSRF token: the
+// IdP redirects browsers here, or POSTs directly to them, with no Kratos-issued CSRF
+// cookie in play. registerCSRFIgnorePaths resolves these against every configured
+// provider, both at startup and whenever watchConfig detects a config change, so that a
+// hot-added provider's routes are exempted without a restart.
+var csrfExemptRoutes = []string{RouteSamlLoginInit, RouteSamlAcs, RouteSamlSlo, RouteSamlSloCallback}
+
 func (h *Handler) RegisterPublicRoutes(router *x.RouterPublic) {
 
-	h.d.CSRFHandler().IgnorePath(RouteSamlLoginInit)
-	h.d.CSRFHandler().IgnorePath(RouteSamlAcs)
+	h.registerCSRFIgnorePaths(csrfExemptRoutes...)
 
 	router.GET(RouteSamlMetadata, h.submitMetadata)
 	router.GET(RouteSamlLoginInit, h.loginWithIdp)
+	router.GET(RouteSamlDiscovery, h.discovery)
+
+	router.GET(RouteSamlSlo, h.sloInit)
+	router.GET(RouteSamlSloCallback, h.sloCallback)
+	router.POST(RouteSamlSloCallback, h.sloCallback)
+}
+
+// registerCSRFIgnorePaths exempts each of routes from CSRF checks once per configured
+// provider, resolving the :provider placeholder first. CSRFHandler().IgnorePath compares
+// against the literal request path, so registering the raw ":provider" template never
+// matched an actual multi-provider request.
+func (h *Handler) registerCSRFIgnorePaths(routes ...string) {
+	c, err := decodeConfiguration(h.d.Config(context.Background()))
+	if err != nil {
+		h.d.Logger().WithError(err).Error("Unable to decode SAML strategy configuration; CSRF-exempt routes for configured providers were not registered.")
+		return
+	}
+
+	for _, p := range c.SAMLProviders {
+		for _, route := range routes {
+			h.d.CSRFHandler().IgnorePath(providerRoute(route, p.ID))
+		}
+	}
 }
 
-// Handle /selfservice/methods/saml/metadata
+// Handle /self-service/methods/saml/{provider}/metadata
 func (h *Handler) submitMetadata(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	m, err := h.d.SAMLMiddlewareManager().Get(r.Context(), ps.ByName("provider"))
+	if err != nil {
+		h.d.SelfServiceErrorManager().Forward(r.Context(), w, r, err)
+		return
+	}
+
+	m.ServeMetadata(w, r)
+}
+
+// swagger:model selfServiceSamlDiscoveryItem
+type selfServiceSamlDiscoveryItem struct {
+	// ID is the provider's unique identifier, as configured under saml.config.providers[].id
+	ID string `json:"id"`
+
+	// Label is a human-readable name shown to the user when choosing an IdP
+	Label string `json:"label,omitempty"`
 
-	if samlMiddleware == nil {
-		h.instantiateMiddleware(r)
+	// Icon is a URL pointing to an icon representing the IdP
+	Icon string `json:"icon,omitempty"`
+
+	// MetadataURL is this provider's SP metadata endpoint
+	//
+	// format: uri
+	MetadataURL string `json:"saml_metadata_url"`
+
+	// LoginURL starts the browser login flow against this provider
+	//
+	// format: uri
+	LoginURL string `json:"saml_login_url"`
+
+	// AcsURL is this provider's Assertion Consumer Service endpoint
+	//
+	// format: uri
+	AcsURL string `json:"saml_acs_url"`
+}
+
+// swagger:route GET /self-service/methods/saml/discovery v0alpha2 selfServiceSamlDiscovery
+//
+// List the configured SAML Identity Providers
+//
+// Returns every configured SAML provider along with the URLs needed to start a login
+// flow against it or fetch its Service Provider metadata. Useful for rendering an IdP
+// picker when multiple providers are configured.
+//
+//     Schemes: http, https
+//
+//     Responses:
+//       200: selfServiceSamlDiscoveryItem
+//       500: jsonError
+func (h *Handler) discovery(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	c, err := h.configuration(r)
+	if err != nil {
+		h.d.SelfServiceErrorManager().Forward(r.Context(), w, r, err)
+		return
+	}
+
+	publicURL := strings.TrimRight(h.d.Config(r.Context()).SelfPublicURL().String(), "/")
+
+	items := make([]selfServiceSamlDiscoveryItem, 0, len(c.SAMLProviders))
+	for _, p := range c.SAMLProviders {
+		items = append(items, selfServiceSamlDiscoveryItem{
+			ID:          p.ID,
+			Label:       p.Label,
+			Icon:        p.Icon,
+			MetadataURL: publicURL + providerRoute(RouteSamlMetadata, p.ID),
+			LoginURL:    publicURL + providerRoute(RouteSamlLoginInit, p.ID),
+			AcsURL:      publicURL + providerRoute(RouteSamlAcs, p.ID),
+		})
 	}
 
-	samlMiddleware.ServeMetadata(w, r)
+	h.d.Writer().Write(w, r, items)
+}
+
+func providerRoute(route, providerID string) string {
+	return strings.Replace(route, ":provider", providerID, 1)
 }
 
 // swagger:route GET /self-service/methods/saml/browser v0alpha2 initializeSelfServiceSamlFlowForBrowsers
@@ -133,11 +240,11 @@ func (h *Handler) submitMetadata(w http.ResponseWriter, r *http.Request, ps http
 //       500: jsonError
 func (h *Handler) loginWithIdp(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
 
-	// Middleware is a singleton so we have to verify that it exist
-	if samlMiddleware == nil {
-		if err := h.instantiateMiddleware(r); err != nil {
-			h.d.SelfServiceErrorManager().Forward(r.Context(), w, r, err)
-		}
+	providerID := ps.ByName("provider")
+	m, err := h.d.SAMLMiddlewareManager().Get(r.Context(), providerID)
+	if err != nil {
+		h.d.SelfServiceErrorManager().Forward(r.Context(), w, r, err)
+		return
 	}
 
 	conf := h.d.Config(r.Context())
@@ -146,7 +253,7 @@ func (h *Handler) loginWithIdp(w http.ResponseWriter, r *http.Request, ps httpro
 	if _, err := h.d.SessionManager().FetchFromRequest(r.Context(), r); err != nil {
 		if e := new(session.ErrNoActiveSessionFound); errors.As(err, &e) {
 			// No session exists yet
-			samlMiddleware.HandleStartAuthFlow(w, r)
+			m.HandleStartAuthFlow(w, r)
 		} else {
 			// A session already exist, we redirect to the main page
 			http.Redirect(w, r, conf.SelfServiceBrowserDefaultReturnTo().Path, http.StatusTemporaryRedirect)
@@ -157,161 +264,17 @@ func (h *Handler) loginWithIdp(w http.ResponseWriter, r *http.Request, ps httpro
 	}
 }
 
-func (h *Handler) instantiateMiddleware(r *http.Request) error {
-
-	//Create a SAMLProvider object from the config file
-	config := h.d.Config(r.Context())
-	var c samlstrategy.ConfigurationCollection
-	conf := config.SelfServiceStrategy("saml").Config
-	if err := jsonx.
-		NewStrictDecoder(bytes.NewBuffer(conf)).
-		Decode(&c); err != nil {
-		return errors.Wrapf(err, "Unable to decode config %v", string(conf))
-	}
-
-	//Key pair to encrypt and sign SAML requests
-	keyPair, err := tls.LoadX509KeyPair(strings.Replace(c.SAMLProviders[len(c.SAMLProviders)-1].PublicCertPath, "file://", "", 1), strings.Replace(c.SAMLProviders[len(c.SAMLProviders)-1].PrivateKeyPath, "file://", "", 1))
-	if err != nil {
-		return err
-	}
-	keyPair.Leaf, err = x509.ParseCertificate(keyPair.Certificate[0])
-	if err != nil {
-		return err
-	}
-
-	var idpMetadata *samlidp.EntityDescriptor
-
-	//We check if the metadata file is provided
-	if c.SAMLProviders[len(c.SAMLProviders)-1].IDPInformation["idp_metadata_url"] != "" {
-
-		//The metadata file is provided
-		idpMetadataURL, err := url.Parse(c.SAMLProviders[len(c.SAMLProviders)-1].IDPInformation["idp_metadata_url"])
-		if err != nil {
-			return err
-		}
-
-		//Parse the content of metadata file into a Golang struct
-		idpMetadata, err = samlsp.FetchMetadata(context.Background(), http.DefaultClient, *idpMetadataURL)
-		if err != nil {
-			return err
-		}
-
-	} else {
-
-		//The metadata file is not provided
-		// So were are creating fake IDP metadata based on what is provided by the user on the config file
-		entityIDURL, err := url.Parse(c.SAMLProviders[len(c.SAMLProviders)-1].IDPInformation["idp_entity_id"]) //A modifier
-		if err != nil {
-			return err
-		}
-
-		// The IDP SSO URL
-		IDPSSOURL, err := url.Parse(c.SAMLProviders[len(c.SAMLProviders)-1].IDPInformation["idp_sso_url"])
-		if err != nil {
-			return err
-		}
-
-		// The IDP Logout URL
-		IDPlogoutURL, err := url.Parse(c.SAMLProviders[len(c.SAMLProviders)-1].IDPInformation["idp_logout_url"])
-		if err != nil {
-			return err
-		}
-
-		// The certificate of the IDP
-		certificate, err := ioutil.ReadFile(strings.Replace(c.SAMLProviders[len(c.SAMLProviders)-1].IDPInformation["idp_certificate_path"], "file://", "", 1))
-		if err != nil {
-			return err
-		}
-
-		// We parse it into a x509.Certificate object
-		IDPCertificate := mustParseCertificate(certificate)
-
-		// Because the metadata file is not provided, we need to simulate an IDP to create artificial metadata from the data entered in the conf file
-		simulatedIDP := samlidp.IdentityProvider{
-			Key:         nil,
-			Certificate: IDPCertificate,
-			Logger:      nil,
-			MetadataURL: *entityIDURL,
-			SSOURL:      *IDPSSOURL,
-			LogoutURL:   *IDPlogoutURL,
-		}
-
-		// Now we assign the artificial metadata to our SP to act as if it had been filled in
-		idpMetadata = simulatedIDP.Metadata()
-
-	}
-
-	// The main URL
-	rootURL, err := url.Parse(config.SelfServiceBrowserDefaultReturnTo().String())
-	if err != nil {
-		return err
-	}
-
-	// Here we create a MiddleWare to transform Kratos into a Service Provider
-	samlMiddleWare, err := samlsp.New(samlsp.Options{
-		URL:         *rootURL,
-		Key:         keyPair.PrivateKey.(*rsa.PrivateKey),
-		Certificate: keyPair.Leaf,
-		IDPMetadata: idpMetadata,
-		SignRequest: true,
-	})
-	if err != nil {
-		return err
-	}
-
-	var publicUrlString = config.SelfPublicURL().String()
-
-	// Sometimes there is an issue with double slash into the url so we prevent it
-	// Crewjam library use default route for ACS and metadat but we want to overwrite them
-	RouteSamlAcsWithSlash := RouteSamlAcs
-	if publicUrlString[len(publicUrlString)-1] != '/' {
-
-		u, err := url.Parse(publicUrlString + RouteSamlAcsWithSlash)
-		if err != nil {
-			return err
-		}
-		samlMiddleWare.ServiceProvider.AcsURL = *u
-
-	} else if publicUrlString[len(publicUrlString)-1] == '/' {
-
-		publicUrlString = publicUrlString[:len(publicUrlString)-1]
-		u, err := url.Parse(publicUrlString + RouteSamlAcsWithSlash)
-		if err != nil {
-			return err
-		}
-		samlMiddleWare.ServiceProvider.AcsURL = *u
-	}
-
-	// Crewjam library use default route for ACS and metadat but we want to overwrite them
-	metadata, err := url.Parse(publicUrlString + RouteSamlMetadata)
-	samlMiddleWare.ServiceProvider.MetadataURL = *metadata
-
-	// The EntityID in the AuthnRequest is the Metadata URL
-	samlMiddleWare.ServiceProvider.EntityID = samlMiddleWare.ServiceProvider.MetadataURL.String()
-
-	// The issuer format is unspecified
-	samlMiddleWare.ServiceProvider.AuthnNameIDFormat = samlidp.UnspecifiedNameIDFormat
-
-	samlMiddleware = samlMiddleWare
-
-	return nil
+// configuration decodes the SAML strategy configuration into a ConfigurationCollection.
+func (h *Handler) configuration(r *http.Request) (*samlstrategy.ConfigurationCollection, error) {
+	return decodeConfiguration(h.d.Config(r.Context()))
 }
 
-func GetMiddleware() (*samlsp.Middleware, error) {
-	if samlMiddleware == nil {
-		return nil, errors.Errorf("The MiddleWare for SAML is null (Probably due to a backward step)")
-	}
-	return samlMiddleware, nil
-}
-
-func mustParseCertificate(pemStr []byte) *x509.Certificate {
-	b, _ := pem.Decode(pemStr)
-	if b == nil {
-		panic("cannot parse PEM")
-	}
-	cert, err := x509.ParseCertificate(b.Bytes)
-	if err != nil {
-		panic(err)
+// providerConfig returns the configuration of the provider matching providerID.
+func providerConfig(c *samlstrategy.ConfigurationCollection, providerID string) (*samlstrategy.Configuration, error) {
+	for i := range c.SAMLProviders {
+		if c.SAMLProviders[i].ID == providerID {
+			return &c.SAMLProviders[i], nil
+		}
 	}
-	return cert
+	return nil, errors.WithStack(ErrUnknownProvider)
 }
@@ -0,0 +1,41 @@
+package saml
+
+import (
+	"errors"
+	"testing"
+
+	samlstrategy "github.com/ory/kratos/selfservice/strategy/saml"
+)
+
+func TestProviderConfig(t *testing.T) {
+	c := &samlstrategy.ConfigurationCollection{
+		SAMLProviders: []samlstrategy.Configuration{
+			{ID: "okta"},
+			{ID: "azure-ad"},
+		},
+	}
+
+	t.Run("finds a configured provider", func(t *testing.T) {
+		p, err := providerConfig(c, "azure-ad")
+		if err != nil {
+			t.Fatalf("providerConfig: %v", err)
+		}
+		if p.ID != "azure-ad" {
+			t.Fatalf("providerConfig() = %+v, want ID azure-ad", p)
+		}
+	})
+
+	t.Run("returns ErrUnknownProvider for an unconfigured provider", func(t *testing.T) {
+		if _, err := providerConfig(c, "does-not-exist"); !errors.Is(err, ErrUnknownProvider) {
+			t.Fatalf("providerConfig() error = %v, want ErrUnknownProvider", err)
+		}
+	})
+}
+
+func TestProviderRoute(t *testing.T) {
+	got := providerRoute(RouteSamlAcs, "okta")
+	want := "/self-service/methods/saml/okta/acs"
+	if got != want {
+		t.Fatalf("providerRoute() = %q, want %q", got, want)
+	}
+}
@@ -0,0 +1,441 @@
+package saml
+
+import (
+	"crypto/sha256"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	samlidp "github.com/crewjam/saml"
+	"github.com/crewjam/saml/samlsp"
+	"github.com/gofrs/uuid"
+	"github.com/pkg/errors"
+	josejwt "gopkg.in/square/go-jose.v2"
+	"gopkg.in/square/go-jose.v2/jwt"
+
+	"github.com/ory/kratos/driver/config"
+	samlstrategy "github.com/ory/kratos/selfservice/strategy/saml"
+)
+
+// cookieValueLimit is the practical size limit most browsers enforce on a single
+// cookie's value; assertions encoded past this are split across numbered cookies
+// (name, name_1, name_2, ...) and reassembled on read.
+const cookieValueLimit = 4 * 1024
+
+// jwtKeyset signs with the newest Kratos session secret and verifies against any
+// configured secret, so an operator can rotate the secret without breaking in-flight
+// SAML logins or invalidating already-issued session/request-tracker cookies.
+type jwtKeyset struct {
+	signing  josejwt.SigningKey
+	verify   []interface{}
+	encrypt  *josejwt.Recipient
+	decryptK [][]byte
+}
+
+func newJWTKeyset(secrets [][]byte, encrypted bool) (*jwtKeyset, error) {
+	if len(secrets) == 0 {
+		return nil, errors.New("saml: at least one session secret is required to sign SAML session/request-tracker cookies")
+	}
+
+	ks := &jwtKeyset{}
+	for _, secret := range secrets {
+		ks.verify = append(ks.verify, secret)
+	}
+	ks.signing = josejwt.SigningKey{Algorithm: josejwt.HS256, Key: secrets[0]}
+
+	if encrypted {
+		ks.encrypt = &josejwt.Recipient{Algorithm: josejwt.A256GCMKW, Key: encryptionKey(secrets[0])}
+		for _, secret := range secrets {
+			ks.decryptK = append(ks.decryptK, encryptionKey(secret))
+		}
+	}
+
+	return ks, nil
+}
+
+// encryptionKey derives a 32-byte A256GCM key from an arbitrary-length Kratos secret.
+func encryptionKey(secret []byte) []byte {
+	sum := sha256.Sum256(secret)
+	return sum[:]
+}
+
+func (ks *jwtKeyset) sign(claims interface{}) (string, error) {
+	signer, err := josejwt.NewSigner(ks.signing, (&josejwt.SignerOptions{}).WithType("JWT"))
+	if err != nil {
+		return "", err
+	}
+
+	if ks.encrypt == nil {
+		return jwt.Signed(signer).Claims(claims).CompactSerialize()
+	}
+
+	encrypter, err := josejwt.NewEncrypter(josejwt.A256GCM, *ks.encrypt, (&josejwt.EncrypterOptions{}).WithType("JWT").WithContentType("JWT"))
+	if err != nil {
+		return "", err
+	}
+
+	return jwt.SignedAndEncrypted(signer, encrypter).Claims(claims).CompactSerialize()
+}
+
+func (ks *jwtKeyset) parse(raw string, claims interface{}) error {
+	if ks.encrypt != nil {
+		tok, err := jwt.ParseSignedAndEncrypted(raw)
+		if err != nil {
+			return errors.Wrap(err, "saml: unable to parse encrypted JWT")
+		}
+
+		var lastErr error
+		for _, key := range ks.decryptK {
+			nested, err := tok.Decrypt(key)
+			if err != nil {
+				lastErr = err
+				continue
+			}
+			if err := verifyWithAnyKey(nested, ks.verify, claims); err != nil {
+				lastErr = err
+				continue
+			}
+			return nil
+		}
+		return errors.Wrap(lastErr, "saml: unable to decrypt/verify JWT with any configured secret")
+	}
+
+	tok, err := jwt.ParseSigned(raw)
+	if err != nil {
+		return errors.Wrap(err, "saml: unable to parse signed JWT")
+	}
+	return verifyWithAnyKey(tok, ks.verify, claims)
+}
+
+func verifyWithAnyKey(tok *jwt.JSONWebToken, keys []interface{}, claims interface{}) error {
+	var lastErr error
+	for _, key := range keys {
+		if err := tok.Claims(key, claims); err != nil {
+			lastErr = err
+			continue
+		}
+		return nil
+	}
+	return errors.Wrap(lastErr, "saml: JWT signature did not verify against any configured secret")
+}
+
+// sessionClaims is what we serialize into the session cookie: the attributes needed to
+// rebuild a samlsp.Session without holding onto the raw assertion.
+type sessionClaims struct {
+	jwt.Claims
+	SAMLAssertion *samlidp.Assertion `json:"saml_assertion"`
+}
+
+// JWTSessionCodec implements samlsp.SessionCodec using signed (and optionally
+// encrypted) JWTs instead of crewjam's gob-based default, so that session state
+// survives a Kratos restart and key rotation doesn't invalidate every open SAML
+// session at once.
+type JWTSessionCodec struct {
+	keys   *jwtKeyset
+	maxAge time.Duration
+}
+
+func NewJWTSessionCodec(secrets [][]byte, encrypted bool, maxAge time.Duration) (*JWTSessionCodec, error) {
+	keys, err := newJWTKeyset(secrets, encrypted)
+	if err != nil {
+		return nil, err
+	}
+	return &JWTSessionCodec{keys: keys, maxAge: maxAge}, nil
+}
+
+func (c *JWTSessionCodec) New(assertion *samlidp.Assertion) (samlsp.Session, error) {
+	now := time.Now()
+	return &sessionClaims{
+		Claims: jwt.Claims{
+			Expiry:   jwt.NewNumericDate(now.Add(c.maxAge)),
+			IssuedAt: jwt.NewNumericDate(now),
+		},
+		SAMLAssertion: assertion,
+	}, nil
+}
+
+func (c *JWTSessionCodec) Encode(s samlsp.Session) (string, error) {
+	claims, ok := s.(*sessionClaims)
+	if !ok {
+		return "", errors.New("saml: unexpected session type for JWTSessionCodec")
+	}
+	return c.keys.sign(claims)
+}
+
+func (c *JWTSessionCodec) Decode(raw string) (samlsp.Session, error) {
+	var claims sessionClaims
+	if err := c.keys.parse(raw, &claims); err != nil {
+		return nil, err
+	}
+	if err := claims.Claims.Validate(jwt.Expected{Time: time.Now()}); err != nil {
+		return nil, errors.Wrap(err, "saml: session JWT failed validation")
+	}
+	return &claims, nil
+}
+
+// CreateSession implements samlsp.SessionProvider on the package's own
+// CookieSessionProvider (see handler.go), which until now was defined but never used -
+// the middleware ran on crewjam's unexported default instead. Unlike crewjam's default,
+// an encoded session that exceeds cookieValueLimit is split across several numbered
+// cookies (c.Name, c.Name+"_1", ...) instead of silently getting truncated by the
+// browser.
+func (c *CookieSessionProvider) CreateSession(w http.ResponseWriter, r *http.Request, assertion *samlidp.Assertion) error {
+	session, err := c.Codec.New(assertion)
+	if err != nil {
+		return err
+	}
+
+	encoded, err := c.Codec.Encode(session)
+	if err != nil {
+		return err
+	}
+
+	for i, chunk := range chunkString(encoded, cookieValueLimit) {
+		http.SetCookie(w, &http.Cookie{
+			Name:     cookieChunkName(c.Name, i),
+			Value:    chunk,
+			Domain:   c.Domain,
+			HttpOnly: c.HTTPOnly,
+			Secure:   c.Secure,
+			SameSite: c.SameSite,
+			Path:     "/",
+			MaxAge:   int(c.MaxAge.Seconds()),
+		})
+	}
+	return nil
+}
+
+func (c *CookieSessionProvider) GetSession(r *http.Request) (samlsp.Session, error) {
+	var b strings.Builder
+	for i := 0; ; i++ {
+		cookie, err := r.Cookie(cookieChunkName(c.Name, i))
+		if err != nil {
+			break
+		}
+		b.WriteString(cookie.Value)
+	}
+	if b.Len() == 0 {
+		return nil, samlsp.ErrNoSession
+	}
+	return c.Codec.Decode(b.String())
+}
+
+func (c *CookieSessionProvider) DeleteSession(w http.ResponseWriter, r *http.Request) error {
+	for i := 0; ; i++ {
+		name := cookieChunkName(c.Name, i)
+		if _, err := r.Cookie(name); err != nil {
+			break
+		}
+		http.SetCookie(w, &http.Cookie{Name: name, Value: "", MaxAge: -1, Domain: c.Domain, Path: "/"})
+	}
+	return nil
+}
+
+func cookieChunkName(base string, i int) string {
+	if i == 0 {
+		return base
+	}
+	return base + "_" + strconv.Itoa(i)
+}
+
+func chunkString(s string, size int) []string {
+	if len(s) <= size {
+		return []string{s}
+	}
+	var chunks []string
+	for len(s) > 0 {
+		end := size
+		if end > len(s) {
+			end = len(s)
+		}
+		chunks = append(chunks, s[:end])
+		s = s[end:]
+	}
+	return chunks
+}
+
+// JWTRequestTracker tracks in-flight AuthnRequest IDs the same way crewjam's default
+// CookieRequestTracker does, but serializes the tracked request as a signed JWT so it
+// survives a Kratos restart mid-flow instead of being silently lost.
+type JWTRequestTracker struct {
+	keys       *jwtKeyset
+	maxAge     time.Duration
+	namePrefix string
+	domain     string
+	secure     bool
+	sameSite   http.SameSite
+}
+
+type trackedRequestClaims struct {
+	jwt.Claims
+	SAMLRequestID string `json:"saml_request_id"`
+	URI           string `json:"uri"`
+}
+
+func (t *JWTRequestTracker) TrackRequest(w http.ResponseWriter, r *http.Request, samlRequestID string) (string, error) {
+	id, err := uuid.NewV4()
+	if err != nil {
+		return "", err
+	}
+
+	now := time.Now()
+	claims := trackedRequestClaims{
+		Claims: jwt.Claims{
+			ID:       id.String(),
+			Expiry:   jwt.NewNumericDate(now.Add(t.maxAge)),
+			IssuedAt: jwt.NewNumericDate(now),
+		},
+		SAMLRequestID: samlRequestID,
+		URI:           r.URL.String(),
+	}
+
+	token, err := t.keys.sign(claims)
+	if err != nil {
+		return "", err
+	}
+
+	http.SetCookie(w, &http.Cookie{
+		Name:     t.namePrefix + id.String(),
+		Value:    token,
+		Domain:   t.domain,
+		HttpOnly: true,
+		Secure:   t.secure,
+		SameSite: t.sameSite,
+		Path:     "/",
+		MaxAge:   int(t.maxAge.Seconds()),
+	})
+
+	return id.String(), nil
+}
+
+func (t *JWTRequestTracker) StopTrackingRequest(w http.ResponseWriter, r *http.Request, trackingID string) error {
+	http.SetCookie(w, &http.Cookie{Name: t.namePrefix + trackingID, Value: "", MaxAge: -1, Path: "/"})
+	return nil
+}
+
+func (t *JWTRequestTracker) GetTrackedRequests(r *http.Request) []samlsp.TrackedRequest {
+	var reqs []samlsp.TrackedRequest
+	for _, cookie := range r.Cookies() {
+		if !strings.HasPrefix(cookie.Name, t.namePrefix) {
+			continue
+		}
+
+		claims, err := t.parseAndValidate(cookie.Value)
+		if err != nil {
+			continue
+		}
+
+		reqs = append(reqs, samlsp.TrackedRequest{
+			Index:         strings.TrimPrefix(cookie.Name, t.namePrefix),
+			SAMLRequestID: claims.SAMLRequestID,
+			URI:           claims.URI,
+		})
+	}
+	return reqs
+}
+
+func (t *JWTRequestTracker) GetTrackedRequest(r *http.Request, trackingID string) (*samlsp.TrackedRequest, error) {
+	cookie, err := r.Cookie(t.namePrefix + trackingID)
+	if err != nil {
+		return nil, errors.Wrap(err, "saml: no tracked request for this ID")
+	}
+
+	claims, err := t.parseAndValidate(cookie.Value)
+	if err != nil {
+		return nil, err
+	}
+
+	return &samlsp.TrackedRequest{
+		Index:         trackingID,
+		SAMLRequestID: claims.SAMLRequestID,
+		URI:           claims.URI,
+	}, nil
+}
+
+// parseAndValidate parses a tracked-request JWT and enforces the Expiry set in
+// TrackRequest, the same way JWTSessionCodec.Decode enforces it on the session cookie -
+// without this, a stale tracked AuthnRequest cookie would stay acceptable to
+// ParseResponse's replay checks for as long as the signature verifies, regardless of how
+// long ago it was issued.
+func (t *JWTRequestTracker) parseAndValidate(raw string) (*trackedRequestClaims, error) {
+	var claims trackedRequestClaims
+	if err := t.keys.parse(raw, &claims); err != nil {
+		return nil, err
+	}
+	if err := claims.Claims.Validate(jwt.Expected{Time: time.Now()}); err != nil {
+		return nil, errors.Wrap(err, "saml: tracked request JWT failed validation")
+	}
+	return &claims, nil
+}
+
+// buildSession builds the samlsp.SessionProvider used for a given provider's
+// middleware: a JWT-backed, cookie-splitting CookieSessionProvider seeded from
+// Kratos's own session secrets (see config.Config.SecretsSession) and the per-provider
+// cookie settings in p.IDPInformation, instead of crewjam's gob-encoded default.
+func buildSession(conf *config.Config, p *samlstrategy.Configuration, providerID string) (samlsp.SessionProvider, error) {
+	codec, err := NewJWTSessionCodec(conf.SecretsSession(), sessionCookieEncrypted(p), sessionMaxAge(p))
+	if err != nil {
+		return nil, err
+	}
+
+	return &CookieSessionProvider{
+		Name:     "ory_kratos_saml_session_" + providerID,
+		Domain:   p.IDPInformation["session_cookie_domain"],
+		HTTPOnly: true,
+		Secure:   sessionCookieSecure(p),
+		SameSite: sessionCookieSameSite(p),
+		MaxAge:   sessionMaxAge(p),
+		Codec:    codec,
+	}, nil
+}
+
+// buildRequestTracker builds the samlsp.RequestTracker used for a given provider's
+// middleware: a JWT-backed tracker sharing the same rotation-aware keyset as the
+// session cookie, instead of crewjam's gob-encoded CookieRequestTracker.
+func buildRequestTracker(conf *config.Config, p *samlstrategy.Configuration, providerID string) (samlsp.RequestTracker, error) {
+	keys, err := newJWTKeyset(conf.SecretsSession(), sessionCookieEncrypted(p))
+	if err != nil {
+		return nil, err
+	}
+
+	return &JWTRequestTracker{
+		keys:       keys,
+		maxAge:     samlsp.DefaultSessionMaxAge,
+		namePrefix: "ory_kratos_saml_trackedrequest_" + providerID + "_",
+		domain:     p.IDPInformation["session_cookie_domain"],
+		secure:     sessionCookieSecure(p),
+		sameSite:   sessionCookieSameSite(p),
+	}, nil
+}
+
+func sessionCookieEncrypted(p *samlstrategy.Configuration) bool {
+	return p.IDPInformation["session_cookie_encrypt"] == "true"
+}
+
+func sessionCookieSecure(p *samlstrategy.Configuration) bool {
+	if raw, ok := p.IDPInformation["session_cookie_secure"]; ok {
+		return raw == "true"
+	}
+	return true
+}
+
+func sessionCookieSameSite(p *samlstrategy.Configuration) http.SameSite {
+	switch p.IDPInformation["session_cookie_same_site"] {
+	case "strict":
+		return http.SameSiteStrictMode
+	case "none":
+		return http.SameSiteNoneMode
+	default:
+		return http.SameSiteLaxMode
+	}
+}
+
+func sessionMaxAge(p *samlstrategy.Configuration) time.Duration {
+	if raw := p.IDPInformation["session_cookie_max_age"]; raw != "" {
+		if d, err := time.ParseDuration(raw); err == nil {
+			return d
+		}
+	}
+	return samlsp.DefaultSessionMaxAge
+}
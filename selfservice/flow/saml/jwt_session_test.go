@@ -0,0 +1,187 @@
+package saml
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	samlidp "github.com/crewjam/saml"
+)
+
+func TestJWTSessionCodecRoundTrip(t *testing.T) {
+	assertion := &samlidp.Assertion{ID: "assertion-id"}
+
+	for _, tc := range []struct {
+		name      string
+		encrypted bool
+	}{
+		{"signed", false},
+		{"signed and encrypted", true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			codec, err := NewJWTSessionCodec([][]byte{[]byte("a-very-secret-session-key-123456")}, tc.encrypted, time.Hour)
+			if err != nil {
+				t.Fatalf("NewJWTSessionCodec: %v", err)
+			}
+
+			session, err := codec.New(assertion)
+			if err != nil {
+				t.Fatalf("New: %v", err)
+			}
+
+			encoded, err := codec.Encode(session)
+			if err != nil {
+				t.Fatalf("Encode: %v", err)
+			}
+			if encoded == "" {
+				t.Fatal("Encode returned an empty token")
+			}
+
+			decoded, err := codec.Decode(encoded)
+			if err != nil {
+				t.Fatalf("Decode: %v", err)
+			}
+
+			claims, ok := decoded.(*sessionClaims)
+			if !ok {
+				t.Fatalf("Decode returned %T, want *sessionClaims", decoded)
+			}
+			if claims.SAMLAssertion == nil || claims.SAMLAssertion.ID != assertion.ID {
+				t.Fatalf("decoded assertion = %+v, want ID %q", claims.SAMLAssertion, assertion.ID)
+			}
+		})
+	}
+}
+
+// TestJWTSessionCodecKeyRotation confirms that adding a new secret ahead of an old one
+// (the documented rotation procedure) keeps sessions signed with the old secret valid,
+// which is the entire point of replacing crewjam's single-secret gob session.
+func TestJWTSessionCodecKeyRotation(t *testing.T) {
+	oldSecret := []byte("old-session-secret-0123456789ab")
+	newSecret := []byte("new-session-secret-0123456789ab")
+
+	oldCodec, err := NewJWTSessionCodec([][]byte{oldSecret}, false, time.Hour)
+	if err != nil {
+		t.Fatalf("NewJWTSessionCodec(old): %v", err)
+	}
+
+	session, err := oldCodec.New(&samlidp.Assertion{ID: "rotated-assertion"})
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	encoded, err := oldCodec.Encode(session)
+	if err != nil {
+		t.Fatalf("Encode: %v", err)
+	}
+
+	rotatedCodec, err := NewJWTSessionCodec([][]byte{newSecret, oldSecret}, false, time.Hour)
+	if err != nil {
+		t.Fatalf("NewJWTSessionCodec(rotated): %v", err)
+	}
+
+	if _, err := rotatedCodec.Decode(encoded); err != nil {
+		t.Fatalf("Decode after rotation: %v", err)
+	}
+}
+
+func TestJWTSessionCodecRejectsExpired(t *testing.T) {
+	codec, err := NewJWTSessionCodec([][]byte{[]byte("expiry-test-secret-0123456789ab")}, false, -time.Hour)
+	if err != nil {
+		t.Fatalf("NewJWTSessionCodec: %v", err)
+	}
+
+	session, err := codec.New(&samlidp.Assertion{ID: "expired-assertion"})
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	encoded, err := codec.Encode(session)
+	if err != nil {
+		t.Fatalf("Encode: %v", err)
+	}
+
+	if _, err := codec.Decode(encoded); err == nil {
+		t.Fatal("Decode accepted an expired session JWT")
+	}
+}
+
+// trackedRequestCookie runs TrackRequest against a fresh response and returns a request
+// carrying the cookie it set, so a later GetTrackedRequest(s) call can read it back.
+func trackedRequestCookie(t *testing.T, tracker *JWTRequestTracker, samlRequestID string) (trackingID string, req *http.Request) {
+	t.Helper()
+
+	rec := httptest.NewRecorder()
+	trackingID, err := tracker.TrackRequest(rec, httptest.NewRequest(http.MethodGet, "/", nil), samlRequestID)
+	if err != nil {
+		t.Fatalf("TrackRequest: %v", err)
+	}
+
+	req = httptest.NewRequest(http.MethodGet, "/", nil)
+	for _, c := range rec.Result().Cookies() {
+		req.AddCookie(c)
+	}
+	return trackingID, req
+}
+
+func TestJWTRequestTrackerRoundTrip(t *testing.T) {
+	keys, err := newJWTKeyset([][]byte{[]byte("tracker-secret-0123456789abcdef")}, false)
+	if err != nil {
+		t.Fatalf("newJWTKeyset: %v", err)
+	}
+	tracker := &JWTRequestTracker{keys: keys, maxAge: time.Hour, namePrefix: "ory_kratos_saml_trackedrequest_test_"}
+
+	trackingID, req := trackedRequestCookie(t, tracker, "saml-request-id")
+
+	got, err := tracker.GetTrackedRequest(req, trackingID)
+	if err != nil {
+		t.Fatalf("GetTrackedRequest: %v", err)
+	}
+	if got.SAMLRequestID != "saml-request-id" {
+		t.Fatalf("GetTrackedRequest() = %+v, want SAMLRequestID saml-request-id", got)
+	}
+
+	all := tracker.GetTrackedRequests(req)
+	if len(all) != 1 || all[0].SAMLRequestID != "saml-request-id" {
+		t.Fatalf("GetTrackedRequests() = %+v, want one entry with SAMLRequestID saml-request-id", all)
+	}
+}
+
+// TestJWTRequestTrackerRejectsExpired guards against the Expiry claim TrackRequest sets
+// silently going unenforced: a stale tracked-AuthnRequest cookie must not stay valid
+// forever just because its signature still checks out.
+func TestJWTRequestTrackerRejectsExpired(t *testing.T) {
+	keys, err := newJWTKeyset([][]byte{[]byte("tracker-secret-0123456789abcdef")}, false)
+	if err != nil {
+		t.Fatalf("newJWTKeyset: %v", err)
+	}
+	tracker := &JWTRequestTracker{keys: keys, maxAge: -time.Hour, namePrefix: "ory_kratos_saml_trackedrequest_test_"}
+
+	trackingID, req := trackedRequestCookie(t, tracker, "expired-request-id")
+
+	if _, err := tracker.GetTrackedRequest(req, trackingID); err == nil {
+		t.Fatal("GetTrackedRequest accepted an expired tracked request")
+	}
+
+	if got := tracker.GetTrackedRequests(req); len(got) != 0 {
+		t.Fatalf("GetTrackedRequests() returned %d expired requests, want 0", len(got))
+	}
+}
+
+func TestChunkStringReassembly(t *testing.T) {
+	const size = 8
+	input := "abcdefghijklmnopqrstuvwxyz"
+
+	chunks := chunkString(input, size)
+
+	var rebuilt string
+	for _, c := range chunks {
+		if len(c) > size {
+			t.Fatalf("chunk %q exceeds size %d", c, size)
+		}
+		rebuilt += c
+	}
+
+	if rebuilt != input {
+		t.Fatalf("reassembled %q, want %q", rebuilt, input)
+	}
+}
@@ -0,0 +1,268 @@
+package saml
+
+import (
+	"context"
+	"crypto/x509"
+	"encoding/xml"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/beevik/etree"
+	"github.com/prometheus/client_golang/prometheus"
+	dsig "github.com/russellhaering/goxmldsig"
+
+	"github.com/pkg/errors"
+
+	samlidp "github.com/crewjam/saml"
+	samlstrategy "github.com/ory/kratos/selfservice/strategy/saml"
+)
+
+const (
+	// defaultMetadataRefreshInterval is used when a provider does not set
+	// idp_metadata_refresh_interval in its IDPInformation.
+	defaultMetadataRefreshInterval = time.Hour
+
+	// refreshJitterFraction bounds the random jitter added to every refresh interval,
+	// as a fraction of the interval, so that many providers configured with the same
+	// interval don't all refetch their metadata at the same instant.
+	refreshJitterFraction = 0.2
+)
+
+var (
+	metadataLastRefreshTimestamp = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "kratos",
+		Subsystem: "selfservice_saml",
+		Name:      "idp_metadata_last_refresh_unix_seconds",
+		Help:      "Unix timestamp of the last successful IdP metadata refresh, per provider.",
+	}, []string{"provider"})
+
+	metadataRefreshFailures = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "kratos",
+		Subsystem: "selfservice_saml",
+		Name:      "idp_metadata_refresh_consecutive_failures",
+		Help:      "Number of consecutive failed IdP metadata refresh attempts, per provider.",
+	}, []string{"provider"})
+)
+
+func init() {
+	prometheus.MustRegister(metadataLastRefreshTimestamp, metadataRefreshFailures)
+}
+
+// MetadataRefresher periodically re-fetches each configured provider's IdP metadata and
+// atomically swaps it onto the cached *samlsp.Middleware, so that an IdP certificate
+// rollover no longer requires a Kratos restart.
+type MetadataRefresher struct {
+	d       managerDependencies
+	manager *MiddlewareManager
+	client  *http.Client
+}
+
+func NewMetadataRefresher(d managerDependencies, manager *MiddlewareManager) *MetadataRefresher {
+	return &MetadataRefresher{
+		d:       d,
+		manager: manager,
+		client:  http.DefaultClient,
+	}
+}
+
+// Start launches one background goroutine per configured provider that has an
+// idp_metadata_url set, and returns immediately. Each goroutine exits when ctx is done.
+func (f *MetadataRefresher) Start(ctx context.Context) error {
+	c, err := decodeConfiguration(f.d.Config(ctx))
+	if err != nil {
+		return err
+	}
+
+	for i := range c.SAMLProviders {
+		p := c.SAMLProviders[i]
+		if p.IDPInformation["idp_metadata_url"] == "" {
+			continue
+		}
+		go f.run(ctx, p)
+	}
+
+	return nil
+}
+
+func (f *MetadataRefresher) run(ctx context.Context, p samlstrategy.Configuration) {
+	interval := providerRefreshInterval(p)
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(jitter(interval)):
+			if err := f.refreshOnce(ctx, p); err != nil {
+				metadataRefreshFailures.WithLabelValues(p.ID).Inc()
+				continue
+			}
+			metadataRefreshFailures.WithLabelValues(p.ID).Set(0)
+			metadataLastRefreshTimestamp.WithLabelValues(p.ID).Set(float64(clock().Unix()))
+		}
+	}
+}
+
+func (f *MetadataRefresher) refreshOnce(ctx context.Context, p samlstrategy.Configuration) error {
+	idpMetadataURL, err := url.Parse(p.IDPInformation["idp_metadata_url"])
+	if err != nil {
+		return errors.Wrapf(err, "saml: provider %q has an invalid idp_metadata_url", p.ID)
+	}
+
+	body, notValidAfter, err := fetchMetadataBody(ctx, f.client, *idpMetadataURL)
+	if err != nil {
+		return err
+	}
+
+	if pins := trustedCertificates(p); len(pins) > 0 {
+		store := dsig.MemoryX509CertificateStore{Roots: pins}
+		if err := verifyXMLSignature(body, &store); err != nil {
+			return errors.Wrapf(err, "saml: metadata signature verification failed for provider %q", p.ID)
+		}
+	}
+
+	var entity samlidp.EntityDescriptor
+	if err := xml.Unmarshal(body, &entity); err != nil {
+		return errors.Wrapf(err, "saml: unable to parse metadata for provider %q", p.ID)
+	}
+
+	// A validUntil on the descriptor is a stronger signal than our own refresh
+	// interval: if the IdP already told us not to trust this past a given time, don't
+	// resurrect it just because HTTP caching said we could.
+	if !notValidAfter.IsZero() && entity.ValidUntil != nil && entity.ValidUntil.After(notValidAfter) {
+		entity.ValidUntil = &notValidAfter
+	}
+
+	mw, err := f.manager.Get(ctx, p.ID)
+	if err != nil {
+		return err
+	}
+
+	// Publish a copy with the refreshed metadata rather than mutating mw in place:
+	// handleCallback/sloInit/sloCallback/loginWithIdp all dereference
+	// ServiceProvider.* off whatever Get last handed them without taking manager.mu, so
+	// mutating the shared value they hold would be a data race. Request paths that
+	// called Get before this point keep using the untouched original; anything calling
+	// Get after f.manager.replace returns sees the refreshed one.
+	updated := *mw
+	updated.ServiceProvider.IDPMetadata = &entity
+	f.manager.replace(p.ID, &updated)
+
+	return nil
+}
+
+// fetchMetadataBody fetches the metadata document, honoring Cache-Control/Expires to
+// compute how long the caller may trust the result for.
+func fetchMetadataBody(ctx context.Context, client *http.Client, u url.URL) ([]byte, time.Time, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, time.Time{}, errors.Errorf("saml: unexpected status %d fetching metadata from %s", resp.StatusCode, u.String())
+	}
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+
+	return body, cacheExpiry(resp.Header), nil
+}
+
+// cacheExpiry derives the point until which a response may be trusted, from
+// Cache-Control: max-age or, failing that, Expires. The zero Time means "unknown".
+func cacheExpiry(h http.Header) time.Time {
+	if cc := h.Get("Cache-Control"); cc != "" {
+		for _, directive := range strings.Split(cc, ",") {
+			directive = strings.TrimSpace(directive)
+			if strings.HasPrefix(directive, "max-age=") {
+				if secs, err := strconv.Atoi(strings.TrimPrefix(directive, "max-age=")); err == nil {
+					return clock().Add(time.Duration(secs) * time.Second)
+				}
+			}
+		}
+	}
+
+	if exp := h.Get("Expires"); exp != "" {
+		if t, err := http.ParseTime(exp); err == nil {
+			return t
+		}
+	}
+
+	return time.Time{}
+}
+
+// verifyXMLSignature validates an embedded XML digital signature (as used on IdP
+// metadata documents and on POST-bound SAML messages) against a store of trusted
+// certificates.
+func verifyXMLSignature(body []byte, store dsig.X509CertificateStore) error {
+	ctx := dsig.NewDefaultValidationContext(store)
+
+	doc := etree.NewDocument()
+	if err := doc.ReadFromBytes(body); err != nil {
+		return errors.Wrap(err, "saml: unable to parse XML document")
+	}
+
+	_, err := ctx.Validate(doc.Root())
+	return err
+}
+
+// trustedCertificates reads a semicolon-separated list of PEM certificate file paths
+// from idp_metadata_signing_certs, used to pin which keys are allowed to sign this
+// provider's metadata.
+func trustedCertificates(p samlstrategy.Configuration) []*x509.Certificate {
+	raw := p.IDPInformation["idp_metadata_signing_certs"]
+	if raw == "" {
+		return nil
+	}
+
+	var certs []*x509.Certificate
+	for _, path := range strings.Split(raw, ";") {
+		path = strings.TrimSpace(strings.Replace(path, "file://", "", 1))
+		if path == "" {
+			continue
+		}
+		pemBytes, err := ioutil.ReadFile(path)
+		if err != nil {
+			continue
+		}
+		cert, err := parseCertificate(pemBytes)
+		if err != nil {
+			continue
+		}
+		certs = append(certs, cert)
+	}
+	return certs
+}
+
+func providerRefreshInterval(p samlstrategy.Configuration) time.Duration {
+	if raw := p.IDPInformation["idp_metadata_refresh_interval"]; raw != "" {
+		if d, err := time.ParseDuration(raw); err == nil && d > 0 {
+			return d
+		}
+	}
+	return defaultMetadataRefreshInterval
+}
+
+func jitter(d time.Duration) time.Duration {
+	delta := time.Duration(float64(d) * refreshJitterFraction)
+	if delta <= 0 {
+		return d
+	}
+	return d - delta + time.Duration(rand.Int63n(int64(2*delta)))
+}
+
+// clock is overridable in tests; production code always uses wall-clock time.
+var clock = time.Now
@@ -0,0 +1,128 @@
+package saml
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"math/big"
+	"testing"
+	"time"
+
+	"github.com/beevik/etree"
+	dsig "github.com/russellhaering/goxmldsig"
+
+	samlstrategy "github.com/ory/kratos/selfservice/strategy/saml"
+)
+
+func samlProviderWithInfo(info map[string]string) samlstrategy.Configuration {
+	return samlstrategy.Configuration{ID: "test-provider", IDPInformation: info}
+}
+
+func selfSignedTestCert(t *testing.T) tls.Certificate {
+	t.Helper()
+
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("GenerateKey: %v", err)
+	}
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "saml-test"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("CreateCertificate: %v", err)
+	}
+
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatalf("ParseCertificate: %v", err)
+	}
+
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key, Leaf: cert}
+}
+
+func signedTestDocument(t *testing.T, cert tls.Certificate) []byte {
+	t.Helper()
+
+	el := etree.NewElement("Response")
+	el.CreateAttr("ID", "_test-response")
+
+	ctx := dsig.NewDefaultSigningContext(dsig.TLSCertKeyStore(cert))
+	signed, err := ctx.SignEnveloped(el)
+	if err != nil {
+		t.Fatalf("SignEnveloped: %v", err)
+	}
+
+	doc := etree.NewDocument()
+	doc.SetRoot(signed)
+	out, err := doc.WriteToBytes()
+	if err != nil {
+		t.Fatalf("WriteToBytes: %v", err)
+	}
+	return out
+}
+
+func TestVerifyXMLSignature(t *testing.T) {
+	cert := selfSignedTestCert(t)
+	body := signedTestDocument(t, cert)
+
+	t.Run("accepts a signature from a trusted certificate", func(t *testing.T) {
+		store := &dsig.MemoryX509CertificateStore{Roots: []*x509.Certificate{cert.Leaf}}
+		if err := verifyXMLSignature(body, store); err != nil {
+			t.Fatalf("verifyXMLSignature: %v", err)
+		}
+	})
+
+	t.Run("rejects a signature from an untrusted certificate", func(t *testing.T) {
+		other := selfSignedTestCert(t)
+		store := &dsig.MemoryX509CertificateStore{Roots: []*x509.Certificate{other.Leaf}}
+		if err := verifyXMLSignature(body, store); err == nil {
+			t.Fatal("verifyXMLSignature accepted a signature from an untrusted certificate")
+		}
+	})
+
+	t.Run("rejects an unsigned document", func(t *testing.T) {
+		el := etree.NewElement("Response")
+		doc := etree.NewDocument()
+		doc.SetRoot(el)
+		unsigned, err := doc.WriteToBytes()
+		if err != nil {
+			t.Fatalf("WriteToBytes: %v", err)
+		}
+
+		store := &dsig.MemoryX509CertificateStore{Roots: []*x509.Certificate{cert.Leaf}}
+		if err := verifyXMLSignature(unsigned, store); err == nil {
+			t.Fatal("verifyXMLSignature accepted an unsigned document")
+		}
+	})
+}
+
+func TestProviderRefreshInterval(t *testing.T) {
+	t.Run("uses the configured interval when valid", func(t *testing.T) {
+		p := samlProviderWithInfo(map[string]string{"idp_metadata_refresh_interval": "5m"})
+		if got, want := providerRefreshInterval(p), 5*time.Minute; got != want {
+			t.Fatalf("providerRefreshInterval() = %v, want %v", got, want)
+		}
+	})
+
+	t.Run("falls back to the default when unset", func(t *testing.T) {
+		p := samlProviderWithInfo(nil)
+		if got, want := providerRefreshInterval(p), defaultMetadataRefreshInterval; got != want {
+			t.Fatalf("providerRefreshInterval() = %v, want %v", got, want)
+		}
+	})
+
+	t.Run("falls back to the default when invalid", func(t *testing.T) {
+		p := samlProviderWithInfo(map[string]string{"idp_metadata_refresh_interval": "not-a-duration"})
+		if got, want := providerRefreshInterval(p), defaultMetadataRefreshInterval; got != want {
+			t.Fatalf("providerRefreshInterval() = %v, want %v", got, want)
+		}
+	})
+}
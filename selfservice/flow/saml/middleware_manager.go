@@ -0,0 +1,292 @@
+package saml
+
+import (
+	"bytes"
+	"context"
+	"crypto/rsa"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"encoding/xml"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+
+	"github.com/pkg/errors"
+
+	samlidp "github.com/crewjam/saml"
+	"github.com/crewjam/saml/samlsp"
+	dsig "github.com/russellhaering/goxmldsig"
+
+	"github.com/ory/kratos/driver/config"
+	samlstrategy "github.com/ory/kratos/selfservice/strategy/saml"
+	"github.com/ory/x/jsonx"
+)
+
+// MiddlewareManagerProvider is implemented by the driver registry to give handlers
+// access to the shared MiddlewareManager instead of reaching for package state.
+type MiddlewareManagerProvider interface {
+	SAMLMiddlewareManager() *MiddlewareManager
+}
+
+type managerDependencies interface {
+	config.Provider
+}
+
+// MiddlewareManager owns the cache of one *samlsp.Middleware per configured SAML
+// provider. It replaces the old package-level samlMiddleware singleton, which was
+// mutated from request handlers with no locking at all. Reads take the read lock so
+// concurrent requests for different (or the same) providers don't race; Invalidate
+// takes the write lock so a config reload can drop a stale entry without tearing down
+// the ones still in use.
+type MiddlewareManager struct {
+	d managerDependencies
+
+	mu          sync.RWMutex
+	middlewares map[string]*samlsp.Middleware
+}
+
+func NewMiddlewareManager(d managerDependencies) *MiddlewareManager {
+	return &MiddlewareManager{
+		d:           d,
+		middlewares: map[string]*samlsp.Middleware{},
+	}
+}
+
+// Get returns the cached middleware for providerID, building and caching it from the
+// current configuration on first use.
+func (m *MiddlewareManager) Get(ctx context.Context, providerID string) (*samlsp.Middleware, error) {
+	m.mu.RLock()
+	mw, ok := m.middlewares[providerID]
+	m.mu.RUnlock()
+	if ok {
+		return mw, nil
+	}
+
+	return m.instantiate(ctx, providerID)
+}
+
+// Invalidate drops the cached middleware for providerID so that the next Get rebuilds
+// it from the then-current configuration. A detected config change (see watchConfig)
+// drops every entry through InvalidateAll instead.
+func (m *MiddlewareManager) Invalidate(providerID string) {
+	m.mu.Lock()
+	delete(m.middlewares, providerID)
+	m.mu.Unlock()
+}
+
+// InvalidateAll drops every cached middleware.
+func (m *MiddlewareManager) InvalidateAll() {
+	m.mu.Lock()
+	m.middlewares = map[string]*samlsp.Middleware{}
+	m.mu.Unlock()
+}
+
+// replace atomically swaps the cached middleware for providerID onto mw. Callers must
+// never mutate a *samlsp.Middleware after it has been published this way: a request
+// holding a reference obtained from Get before the swap keeps seeing the old, untouched
+// value, and one obtained after sees mw, with no lock needed on the read path. This is
+// what lets MetadataRefresher publish refreshed IdP metadata without racing the request
+// handlers that read the middleware's ServiceProvider.
+func (m *MiddlewareManager) replace(providerID string, mw *samlsp.Middleware) {
+	m.mu.Lock()
+	m.middlewares[providerID] = mw
+	m.mu.Unlock()
+}
+
+func (m *MiddlewareManager) instantiate(ctx context.Context, providerID string) (*samlsp.Middleware, error) {
+
+	conf := m.d.Config(ctx)
+
+	c, err := decodeConfiguration(conf)
+	if err != nil {
+		return nil, err
+	}
+
+	p, err := providerConfig(c, providerID)
+	if err != nil {
+		return nil, err
+	}
+
+	//Key pair to encrypt and sign SAML requests
+	keyPair, err := tls.LoadX509KeyPair(strings.Replace(p.PublicCertPath, "file://", "", 1), strings.Replace(p.PrivateKeyPath, "file://", "", 1))
+	if err != nil {
+		return nil, err
+	}
+	keyPair.Leaf, err = x509.ParseCertificate(keyPair.Certificate[0])
+	if err != nil {
+		return nil, err
+	}
+
+	var idpMetadata *samlidp.EntityDescriptor
+
+	//We check if the metadata file is provided
+	if p.IDPInformation["idp_metadata_url"] != "" {
+
+		//The metadata file is provided
+		idpMetadataURL, err := url.Parse(p.IDPInformation["idp_metadata_url"])
+		if err != nil {
+			return nil, err
+		}
+
+		// Route the initial fetch through the same fetchMetadataBody/verifyXMLSignature
+		// path refreshOnce uses on every periodic refresh. Without this, a provider
+		// configured with idp_metadata_signing_certs was only protected once the first
+		// background refresh happened to fire (up to idp_metadata_refresh_interval
+		// later), leaving the first-use fetch and every refetch after an Invalidate
+		// unverified.
+		body, _, err := fetchMetadataBody(ctx, http.DefaultClient, *idpMetadataURL)
+		if err != nil {
+			return nil, err
+		}
+
+		if pins := trustedCertificates(p); len(pins) > 0 {
+			store := dsig.MemoryX509CertificateStore{Roots: pins}
+			if err := verifyXMLSignature(body, &store); err != nil {
+				return nil, errors.Wrapf(err, "saml: metadata signature verification failed for provider %q", p.ID)
+			}
+		}
+
+		var entity samlidp.EntityDescriptor
+		if err := xml.Unmarshal(body, &entity); err != nil {
+			return nil, errors.Wrapf(err, "saml: unable to parse metadata for provider %q", p.ID)
+		}
+		idpMetadata = &entity
+
+	} else {
+
+		//The metadata file is not provided
+		// So were are creating fake IDP metadata based on what is provided by the user on the config file
+		entityIDURL, err := url.Parse(p.IDPInformation["idp_entity_id"]) //A modifier
+		if err != nil {
+			return nil, err
+		}
+
+		// The IDP SSO URL
+		IDPSSOURL, err := url.Parse(p.IDPInformation["idp_sso_url"])
+		if err != nil {
+			return nil, err
+		}
+
+		// The IDP Logout URL
+		IDPlogoutURL, err := url.Parse(p.IDPInformation["idp_logout_url"])
+		if err != nil {
+			return nil, err
+		}
+
+		// The certificate of the IDP
+		certificate, err := ioutil.ReadFile(strings.Replace(p.IDPInformation["idp_certificate_path"], "file://", "", 1))
+		if err != nil {
+			return nil, err
+		}
+
+		// We parse it into a x509.Certificate object
+		IDPCertificate, err := parseCertificate(certificate)
+		if err != nil {
+			return nil, err
+		}
+
+		// Because the metadata file is not provided, we need to simulate an IDP to create artificial metadata from the data entered in the conf file
+		simulatedIDP := samlidp.IdentityProvider{
+			Key:         nil,
+			Certificate: IDPCertificate,
+			Logger:      nil,
+			MetadataURL: *entityIDURL,
+			SSOURL:      *IDPSSOURL,
+			LogoutURL:   *IDPlogoutURL,
+		}
+
+		// Now we assign the artificial metadata to our SP to act as if it had been filled in
+		idpMetadata = simulatedIDP.Metadata()
+
+	}
+
+	// The main URL
+	rootURL, err := url.Parse(conf.SelfServiceBrowserDefaultReturnTo().String())
+	if err != nil {
+		return nil, err
+	}
+
+	// Here we create a MiddleWare to transform Kratos into a Service Provider
+	samlMiddleWare, err := samlsp.New(samlsp.Options{
+		URL:         *rootURL,
+		Key:         keyPair.PrivateKey.(*rsa.PrivateKey),
+		Certificate: keyPair.Leaf,
+		IDPMetadata: idpMetadata,
+		SignRequest: true,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// Replace crewjam's gob-encoded, unrotatable cookie session/request-tracker with
+	// JWT-backed ones keyed off Kratos's own session secrets, so a secret rotation
+	// doesn't invalidate every in-flight SAML login, and large assertions don't get
+	// silently truncated by the browser's per-cookie size limit.
+	if samlMiddleWare.Session, err = buildSession(conf, p, providerID); err != nil {
+		return nil, err
+	}
+	if samlMiddleWare.RequestTracker, err = buildRequestTracker(conf, p, providerID); err != nil {
+		return nil, err
+	}
+
+	publicUrlString := strings.TrimRight(conf.SelfPublicURL().String(), "/")
+
+	// Crewjam library use default route for ACS and metadata but we want to overwrite them
+	// with our per-provider routes.
+	acsURL, err := url.Parse(publicUrlString + providerRoute(RouteSamlAcs, providerID))
+	if err != nil {
+		return nil, err
+	}
+	samlMiddleWare.ServiceProvider.AcsURL = *acsURL
+
+	metadataURL, err := url.Parse(publicUrlString + providerRoute(RouteSamlMetadata, providerID))
+	if err != nil {
+		return nil, err
+	}
+	samlMiddleWare.ServiceProvider.MetadataURL = *metadataURL
+
+	// Without this, the SP metadata we serve advertises no SingleLogoutService at all,
+	// so an IdP has nothing to target with an IdP-initiated LogoutRequest.
+	sloURL, err := url.Parse(publicUrlString + providerRoute(RouteSamlSloCallback, providerID))
+	if err != nil {
+		return nil, err
+	}
+	samlMiddleWare.ServiceProvider.SloURL = *sloURL
+
+	// The EntityID in the AuthnRequest is the Metadata URL
+	samlMiddleWare.ServiceProvider.EntityID = samlMiddleWare.ServiceProvider.MetadataURL.String()
+
+	// The issuer format is unspecified
+	samlMiddleWare.ServiceProvider.AuthnNameIDFormat = samlidp.UnspecifiedNameIDFormat
+
+	m.mu.Lock()
+	m.middlewares[providerID] = samlMiddleWare
+	m.mu.Unlock()
+
+	return samlMiddleWare, nil
+}
+
+// decodeConfiguration decodes the saml strategy configuration into a ConfigurationCollection.
+func decodeConfiguration(conf *config.Config) (*samlstrategy.ConfigurationCollection, error) {
+	var c samlstrategy.ConfigurationCollection
+	raw := conf.SelfServiceStrategy("saml").Config
+	if err := jsonx.
+		NewStrictDecoder(bytes.NewBuffer(raw)).
+		Decode(&c); err != nil {
+		return nil, errors.Wrapf(err, "Unable to decode config %v", string(raw))
+	}
+	return &c, nil
+}
+
+// parseCertificate parses a PEM-encoded certificate, returning an error instead of
+// panicking so a malformed operator-supplied certificate can't take down the process.
+func parseCertificate(pemBytes []byte) (*x509.Certificate, error) {
+	b, _ := pem.Decode(pemBytes)
+	if b == nil {
+		return nil, errors.New("saml: unable to decode PEM certificate")
+	}
+	return x509.ParseCertificate(b.Bytes)
+}
@@ -0,0 +1,13 @@
+package sso_oidc
+
+import (
+	"bytes"
+
+	"github.com/ory/x/jsonx"
+)
+
+// decodeConfig decodes a strategy's raw JSON config, the same way the saml strategy
+// decodes its ConfigurationCollection.
+func decodeConfig(raw []byte, v interface{}) error {
+	return jsonx.NewStrictDecoder(bytes.NewBuffer(raw)).Decode(v)
+}
@@ -0,0 +1,49 @@
+package sso_oidc
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestDecodeConfigAndProviderByID(t *testing.T) {
+	raw := []byte(`{
+		"providers": [
+			{"id": "google", "client_id": "abc", "issuer_url": "https://accounts.google.com"},
+			{"id": "azure", "client_id": "def", "issuer_url": "https://login.microsoftonline.com/common/v2.0"}
+		]
+	}`)
+
+	var c ConfigurationCollection
+	if err := decodeConfig(raw, &c); err != nil {
+		t.Fatalf("decodeConfig: %v", err)
+	}
+
+	if len(c.Providers) != 2 {
+		t.Fatalf("decodeConfig() decoded %d providers, want 2", len(c.Providers))
+	}
+
+	t.Run("finds a configured provider", func(t *testing.T) {
+		p, err := c.providerByID("azure")
+		if err != nil {
+			t.Fatalf("providerByID: %v", err)
+		}
+		if p.ClientID != "def" {
+			t.Fatalf("providerByID() = %+v, want ClientID def", p)
+		}
+	})
+
+	t.Run("returns ErrUnknownProvider for an unconfigured provider", func(t *testing.T) {
+		if _, err := c.providerByID("does-not-exist"); !errors.Is(err, ErrUnknownProvider) {
+			t.Fatalf("providerByID() error = %v, want ErrUnknownProvider", err)
+		}
+	})
+}
+
+func TestDecodeConfigRejectsUnknownFields(t *testing.T) {
+	raw := []byte(`{"providers": [{"id": "google", "not_a_real_field": true}]}`)
+
+	var c ConfigurationCollection
+	if err := decodeConfig(raw, &c); err == nil {
+		t.Fatal("decodeConfig accepted an unknown field")
+	}
+}
@@ -0,0 +1,239 @@
+// Package sso_oidc mirrors the provider-registry plumbing introduced for the saml
+// package (see selfservice/flow/saml.MiddlewareManager) so that a Kratos deployment can
+// declare SSO tenants that speak OIDC discovery + Authorization Code + PKCE alongside
+// ones that speak SAML, behind the same kind of per-provider routes.
+package sso_oidc
+
+import (
+	"context"
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/coreos/go-oidc/v3/oidc"
+	"github.com/julienschmidt/httprouter"
+	"github.com/pkg/errors"
+	"golang.org/x/oauth2"
+
+	"github.com/ory/kratos/driver/config"
+	"github.com/ory/kratos/selfservice/errorx"
+	"github.com/ory/kratos/session"
+	"github.com/ory/kratos/x"
+)
+
+const (
+	RouteBrowser  = "/self-service/methods/sso/oidc/:provider/browser"
+	RouteCallback = "/self-service/methods/sso/oidc/:provider/callback"
+)
+
+var ErrUnknownProvider = errors.New("sso_oidc: unknown provider")
+
+// Configuration is one configured OIDC SSO tenant.
+type Configuration struct {
+	ID           string   `json:"id"`
+	Label        string   `json:"label"`
+	Icon         string   `json:"icon"`
+	IssuerURL    string   `json:"issuer_url"`
+	ClientID     string   `json:"client_id"`
+	ClientSecret string   `json:"client_secret"`
+	Scopes       []string `json:"scope"`
+
+	// MapperURL points at the same kind of Jsonnet claims-to-traits mapper the saml
+	// strategy's provider.Claims already uses, so the two protocols produce identities
+	// the same way.
+	MapperURL string `json:"mapper_url"`
+}
+
+// ConfigurationCollection is the `config` payload of the sso_oidc strategy, mirroring
+// samlstrategy.ConfigurationCollection's shape.
+type ConfigurationCollection struct {
+	Providers []Configuration `json:"providers"`
+}
+
+func (c *ConfigurationCollection) providerByID(id string) (*Configuration, error) {
+	for i := range c.Providers {
+		if c.Providers[i].ID == id {
+			return &c.Providers[i], nil
+		}
+	}
+	return nil, errors.WithStack(ErrUnknownProvider)
+}
+
+// RuntimeProvider bundles the objects derived from OIDC discovery for one provider.
+type RuntimeProvider struct {
+	OAuth2Config *oauth2.Config
+	Verifier     *oidc.IDTokenVerifier
+}
+
+type managerDependencies interface {
+	config.Provider
+}
+
+// ProviderRegistry caches one RuntimeProvider per configured OIDC provider, built from
+// its issuer's discovery document. It is the OIDC analogue of saml.MiddlewareManager:
+// same RWMutex-guarded map, same "build on first use, drop on Invalidate" lifecycle.
+type ProviderRegistry struct {
+	d managerDependencies
+
+	mu        sync.RWMutex
+	providers map[string]*RuntimeProvider
+}
+
+func NewProviderRegistry(d managerDependencies) *ProviderRegistry {
+	return &ProviderRegistry{d: d, providers: map[string]*RuntimeProvider{}}
+}
+
+func (reg *ProviderRegistry) Get(ctx context.Context, providerID string) (*RuntimeProvider, error) {
+	reg.mu.RLock()
+	p, ok := reg.providers[providerID]
+	reg.mu.RUnlock()
+	if ok {
+		return p, nil
+	}
+	return reg.instantiate(ctx, providerID)
+}
+
+func (reg *ProviderRegistry) Invalidate(providerID string) {
+	reg.mu.Lock()
+	delete(reg.providers, providerID)
+	reg.mu.Unlock()
+}
+
+func (reg *ProviderRegistry) instantiate(ctx context.Context, providerID string) (*RuntimeProvider, error) {
+	c, err := reg.configuration(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	conf, err := c.providerByID(providerID)
+	if err != nil {
+		return nil, err
+	}
+
+	issuer, err := oidc.NewProvider(ctx, conf.IssuerURL)
+	if err != nil {
+		return nil, errors.Wrapf(err, "sso_oidc: unable to run OIDC discovery for provider %q", providerID)
+	}
+
+	publicURL := strings.TrimRight(reg.d.Config(ctx).SelfPublicURL().String(), "/")
+
+	oauth2Config := &oauth2.Config{
+		ClientID:     conf.ClientID,
+		ClientSecret: conf.ClientSecret,
+		Endpoint:     issuer.Endpoint(),
+		RedirectURL:  publicURL + strings.Replace(RouteCallback, ":provider", providerID, 1),
+		Scopes:       append([]string{oidc.ScopeOpenID}, conf.Scopes...),
+	}
+
+	runtime := &RuntimeProvider{
+		OAuth2Config: oauth2Config,
+		Verifier:     issuer.Verifier(&oidc.Config{ClientID: conf.ClientID}),
+	}
+
+	reg.mu.Lock()
+	reg.providers[providerID] = runtime
+	reg.mu.Unlock()
+
+	return runtime, nil
+}
+
+// Configuration returns the configured provider's Configuration (including its
+// MapperURL), so that callers outside this package - namely the sso_oidc strategy,
+// which maps ID token claims to identity traits - don't need their own copy of the
+// config-decoding logic.
+func (reg *ProviderRegistry) Configuration(ctx context.Context, providerID string) (*Configuration, error) {
+	c, err := reg.configuration(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return c.providerByID(providerID)
+}
+
+func (reg *ProviderRegistry) configuration(ctx context.Context) (*ConfigurationCollection, error) {
+	var c ConfigurationCollection
+	raw := reg.d.Config(ctx).SelfServiceStrategy("sso_oidc").Config
+	if err := decodeConfig(raw, &c); err != nil {
+		return nil, err
+	}
+	return &c, nil
+}
+
+type (
+	ProviderRegistryProvider interface {
+		SSOOIDCProviderRegistry() *ProviderRegistry
+	}
+	handlerDependencies interface {
+		x.LoggingProvider
+		x.WriterProvider
+		x.CSRFProvider
+		session.ManagementProvider
+		errorx.ManagementProvider
+		config.Provider
+		ProviderRegistryProvider
+	}
+	Handler struct {
+		d handlerDependencies
+	}
+)
+
+func NewHandler(d handlerDependencies) *Handler {
+	return &Handler{d: d}
+}
+
+func (h *Handler) RegisterPublicRoutes(router *x.RouterPublic) {
+	h.registerCSRFIgnorePaths(RouteBrowser, RouteCallback)
+
+	router.GET(RouteBrowser, h.browser)
+}
+
+// registerCSRFIgnorePaths exempts each of routes from CSRF checks once per configured
+// provider, resolving the :provider placeholder first. CSRFHandler().IgnorePath compares
+// against the literal request path, so registering the raw ":provider" template never
+// matched an actual multi-provider request.
+func (h *Handler) registerCSRFIgnorePaths(routes ...string) {
+	c, err := h.d.SSOOIDCProviderRegistry().configuration(context.Background())
+	if err != nil {
+		h.d.Logger().WithError(err).Error("Unable to decode sso_oidc strategy configuration; CSRF-exempt routes for configured providers were not registered.")
+		return
+	}
+
+	for _, p := range c.Providers {
+		for _, route := range routes {
+			h.d.CSRFHandler().IgnorePath(strings.Replace(route, ":provider", p.ID, 1))
+		}
+	}
+}
+
+// browser starts the Authorization Code + PKCE flow: build the code verifier/challenge
+// and state, stash the verifier and the flow ID in a state-keyed cookie (see persistPKCE),
+// and redirect to the provider's authorization endpoint.
+func (h *Handler) browser(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	ctx := r.Context()
+	providerID := ps.ByName("provider")
+
+	if _, err := h.d.SessionManager().FetchFromRequest(ctx, r); err == nil {
+		http.Redirect(w, r, h.d.Config(ctx).SelfServiceBrowserDefaultReturnTo().Path, http.StatusTemporaryRedirect)
+		return
+	}
+
+	p, err := h.d.SSOOIDCProviderRegistry().Get(ctx, providerID)
+	if err != nil {
+		h.d.SelfServiceErrorManager().Forward(ctx, w, r, err)
+		return
+	}
+
+	verifier, state, err := newPKCE()
+	if err != nil {
+		h.d.SelfServiceErrorManager().Forward(ctx, w, r, err)
+		return
+	}
+
+	flowID := r.URL.Query().Get("flow")
+
+	if err := persistPKCE(w, state, verifier, providerID, flowID); err != nil {
+		h.d.SelfServiceErrorManager().Forward(ctx, w, r, err)
+		return
+	}
+
+	http.Redirect(w, r, p.OAuth2Config.AuthCodeURL(state, oauth2.S256ChallengeOption(verifier)), http.StatusSeeOther)
+}
@@ -0,0 +1,48 @@
+package sso_oidc
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"net/http"
+	"time"
+)
+
+const pkceCookiePrefix = "ory_kratos_sso_oidc_pkce_"
+
+// newPKCE generates a code verifier and a state value, both URL-safe random strings.
+func newPKCE() (verifier, state string, err error) {
+	verifier, err = randomURLSafeString(32)
+	if err != nil {
+		return "", "", err
+	}
+	state, err = randomURLSafeString(16)
+	if err != nil {
+		return "", "", err
+	}
+	return verifier, state, nil
+}
+
+func randomURLSafeString(n int) (string, error) {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// persistPKCE stashes the code verifier and the originating login/registration flow ID
+// for this state in a short-lived, HTTP-only cookie keyed by state, so the callback can
+// retrieve both without server-side storage - the same trick samlsp.DefaultRequestTracker
+// uses to track in-flight AuthnRequests.
+func persistPKCE(w http.ResponseWriter, state, verifier, providerID, flowID string) error {
+	http.SetCookie(w, &http.Cookie{
+		Name:     pkceCookiePrefix + state,
+		Value:    providerID + "|" + verifier + "|" + flowID,
+		HttpOnly: true,
+		Secure:   true,
+		SameSite: http.SameSiteLaxMode,
+		Path:     "/",
+		Expires:  time.Now().Add(10 * time.Minute),
+	})
+	return nil
+}
@@ -43,8 +43,8 @@ import (
 const (
 	RouteBase = "/self-service/methods/saml"
 
-	RouteAcs  = RouteBase + "/acs"
-	RouteAuth = RouteBase + "/browser"
+	RouteAcs  = RouteBase + "/:provider/acs"
+	RouteAuth = RouteBase + "/:provider/browser"
 )
 
 var _ identity.ActiveCredentialsCounter = new(Strategy)
@@ -84,6 +84,9 @@ type registrationStrategyDependencies interface {
 
 	session.HandlerProvider
 	session.ManagementProvider
+
+	samlflow.MiddlewareManagerProvider
+	samlflow.PersistenceProvider
 }
 
 type Strategy struct {
@@ -160,7 +163,11 @@ func (s *Strategy) setRoutes(r *x.RouterPublic) {
 	} //ACS SUPPORT
 }
 
-func (s *Strategy) getAttributesFromAssertion(w http.ResponseWriter, r *http.Request, m samlsp.Middleware) (map[string][]string, error) {
+// getAttributesFromAssertion parses the ACS response and returns the attributes carried
+// by its AttributeStatements, along with the NameID and SessionIndex from its
+// AuthnStatements - the pair samlflow.LogoutMapping correlates to a Kratos session so
+// that a later SLO LogoutRequest can find and revoke it.
+func (s *Strategy) getAttributesFromAssertion(w http.ResponseWriter, r *http.Request, m samlsp.Middleware) (attributes map[string][]string, nameID, sessionIndex string, err error) {
 
 	r.ParseForm()
 
@@ -177,10 +184,10 @@ func (s *Strategy) getAttributesFromAssertion(w http.ResponseWriter, r *http.Req
 	assertion, err := m.ServiceProvider.ParseResponse(r, possibleRequestIDs)
 	if err != nil {
 		m.OnError(w, r, err)
-		return nil, err
+		return nil, "", "", err
 	}
 
-	attributes := map[string][]string{}
+	attributes = map[string][]string{}
 
 	for _, attributeStatement := range assertion.AttributeStatements {
 		for _, attr := range attributeStatement.Attributes {
@@ -194,21 +201,38 @@ func (s *Strategy) getAttributesFromAssertion(w http.ResponseWriter, r *http.Req
 		}
 	}
 
-	return attributes, nil
+	if assertion.Subject != nil && assertion.Subject.NameID != nil {
+		nameID = assertion.Subject.NameID.Value
+	}
+
+	for _, authnStatement := range assertion.AuthnStatements {
+		if authnStatement.SessionIndex != "" {
+			sessionIndex = authnStatement.SessionIndex
+			break
+		}
+	}
+
+	return attributes, nameID, sessionIndex, nil
 
 }
 
 func (s *Strategy) handleCallback(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
 
-	m := *samlflow.GetMiddleware()
+	providerID := ps.ByName("provider")
 
-	attributes, err := s.getAttributesFromAssertion(w, r, m)
+	m, err := s.d.SAMLMiddlewareManager().Get(r.Context(), providerID)
 	if err != nil {
 		s.forwardError(w, r, nil, err)
 		return
 	}
 
-	provider, err := s.provider(r.Context(), r)
+	attributes, nameID, sessionIndex, err := s.getAttributesFromAssertion(w, r, *m)
+	if err != nil {
+		s.forwardError(w, r, nil, err)
+		return
+	}
+
+	provider, err := s.provider(r.Context(), providerID)
 	if err != nil {
 		s.forwardError(w, r, nil, err)
 		return
@@ -226,8 +250,37 @@ func (s *Strategy) handleCallback(w http.ResponseWriter, r *http.Request, ps htt
 			return
 		}
 		s.forwardError(w, r, *ff, err)
+		return
 	}
 
+	s.createLogoutMapping(w, r, providerID, nameID, sessionIndex)
+}
+
+// createLogoutMapping persists the NameID/SessionIndex the IdP just asserted against the
+// session processLoginOrRegister has, by now, issued onto this request's context - the
+// same "session attached to the request during IssueCookie" trick the session manager
+// already relies on elsewhere. Without this, sloInit and sloCallback have no way to turn
+// a SessionIndex or a session ID back into the other, so SLO can never find what to
+// revoke. A missing session (e.g. a registration flow awaiting verification) is not an
+// error here; there is simply nothing yet to correlate.
+func (s *Strategy) createLogoutMapping(w http.ResponseWriter, r *http.Request, providerID, nameID, sessionIndex string) {
+	if nameID == "" || sessionIndex == "" {
+		return
+	}
+
+	sess, err := s.d.SessionManager().FetchFromRequest(r.Context(), r)
+	if err != nil {
+		return
+	}
+
+	if err := s.d.SAMLLogoutPersister().CreateLogoutMapping(r.Context(), samlflow.LogoutMapping{
+		ProviderID:   providerID,
+		NameID:       nameID,
+		SessionIndex: sessionIndex,
+		SessionID:    sess.ID,
+	}); err != nil {
+		s.d.Logger().WithError(err).WithField("provider", providerID).Error("Unable to persist SAML logout mapping; Single Logout will not work for this session.")
+	}
 }
 
 func (s *Strategy) forwardError(w http.ResponseWriter, r *http.Request, f flow.Flow, err error) {
@@ -242,18 +295,29 @@ func (s *Strategy) forwardError(w http.ResponseWriter, r *http.Request, f flow.F
 	}
 }
 
-func (s *Strategy) provider(ctx context.Context, r *http.Request) (samlstrategy.Provider, error) {
+func (s *Strategy) provider(ctx context.Context, providerID string) (samlstrategy.Provider, error) {
 	c, err := s.Config(ctx)
 	if err != nil {
 		return nil, err
 	}
 
-	IDPMetadataURL, err := url.Parse(c.SAMLProviders[0].IDPMetadataURL)
+	var conf *samlstrategy.Configuration
+	for i := range c.SAMLProviders {
+		if c.SAMLProviders[i].ID == providerID {
+			conf = &c.SAMLProviders[i]
+			break
+		}
+	}
+	if conf == nil {
+		return nil, errors.Wrapf(samlstrategy.ErrUnknownProvider, "provider %q is not configured", providerID)
+	}
+
+	IDPMetadataURL, err := url.Parse(conf.IDPMetadataURL)
 	if err != nil {
 		return nil, err
 	}
 
-	IDPSSOURL, err := url.Parse(c.SAMLProviders[0].IDPSSOURL)
+	IDPSSOURL, err := url.Parse(conf.IDPSSOURL)
 	if err != nil {
 		return nil, err
 	}
@@ -0,0 +1,316 @@
+package sso_oidc
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"strings"
+
+	"github.com/gofrs/uuid"
+	"github.com/google/go-jsonnet"
+	"github.com/julienschmidt/httprouter"
+	"github.com/ory/herodot"
+	"github.com/pkg/errors"
+	"golang.org/x/oauth2"
+
+	"github.com/ory/kratos/continuity"
+	"github.com/ory/kratos/driver/config"
+	"github.com/ory/kratos/identity"
+	"github.com/ory/kratos/selfservice/errorx"
+	"github.com/ory/kratos/selfservice/flow"
+	"github.com/ory/kratos/selfservice/flow/login"
+	"github.com/ory/kratos/selfservice/flow/registration"
+	ssooidcflow "github.com/ory/kratos/selfservice/flow/sso_oidc"
+	"github.com/ory/kratos/selfservice/strategy"
+	"github.com/ory/kratos/session"
+	"github.com/ory/kratos/ui/node"
+	"github.com/ory/kratos/x"
+	"github.com/ory/x/fetcher"
+)
+
+const ID = "sso_oidc"
+
+var _ identity.ActiveCredentialsCounter = new(Strategy)
+
+type registrationStrategyDependencies interface {
+	x.LoggingProvider
+	x.WriterProvider
+	x.CSRFTokenGeneratorProvider
+	x.CSRFProvider
+
+	config.Provider
+
+	continuity.ManagementProvider
+
+	errorx.ManagementProvider
+
+	registration.HandlerProvider
+	registration.HooksProvider
+	registration.ErrorHandlerProvider
+	registration.HookExecutorProvider
+	registration.FlowPersistenceProvider
+
+	login.HooksProvider
+	login.ErrorHandlerProvider
+	login.HookExecutorProvider
+	login.FlowPersistenceProvider
+	login.HandlerProvider
+
+	identity.PrivilegedPoolProvider
+	identity.ValidationProvider
+
+	session.HandlerProvider
+	session.ManagementProvider
+
+	ssooidcflow.ProviderRegistryProvider
+}
+
+type Strategy struct {
+	d registrationStrategyDependencies
+	f *fetcher.Fetcher
+}
+
+func NewStrategy(d registrationStrategyDependencies) *Strategy {
+	return &Strategy{d: d, f: fetcher.NewFetcher()}
+}
+
+// Claims is what mapClaims produces from an ID token's raw claims: the subject used to
+// correlate this login to an identity, and the traits to apply to it, produced by
+// running the provider's configured Jsonnet mapper - the same claims-to-traits
+// convention the saml strategy's provider.Claims uses for SAML attributes.
+type Claims struct {
+	Subject string
+	Traits  json.RawMessage
+}
+
+func (s *Strategy) CountActiveCredentials(cc map[identity.CredentialsType]identity.Credentials) (count int, err error) {
+	return
+}
+
+func (s *Strategy) ID() identity.CredentialsType {
+	return identity.CredentialsType(ID)
+}
+
+func (s *Strategy) NodeGroup() node.Group {
+	return node.OpenIDConnectGroup
+}
+
+func (s *Strategy) setRoutes(r *x.RouterPublic) {
+	wrappedHandleCallback := strategy.IsDisabled(s.d, ID, s.handleCallback)
+	if handle, _, _ := r.Lookup("GET", ssooidcflow.RouteCallback); handle == nil {
+		r.GET(ssooidcflow.RouteCallback, wrappedHandleCallback)
+	}
+}
+
+// handleCallback completes the Authorization Code + PKCE exchange: it recovers the
+// code verifier stashed by the flow handler's browser redirect, exchanges the
+// authorization code for tokens, verifies the ID token against the provider's JWKS, and
+// maps its claims to identity traits using the same Jsonnet mapper the saml strategy
+// uses for SAML attributes.
+func (s *Strategy) handleCallback(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	ctx := r.Context()
+	providerID := ps.ByName("provider")
+
+	if errParam := r.URL.Query().Get("error"); errParam != "" {
+		s.forwardError(w, r, nil, errors.WithStack(herodot.ErrBadRequest.WithReasonf(
+			`Unable to complete OIDC flow because provider %q returned error "%s": %s`,
+			providerID, errParam, r.URL.Query().Get("error_description"))))
+		return
+	}
+
+	state := r.URL.Query().Get("state")
+	verifier, flowID, err := s.recoverPKCEState(r, providerID, state)
+	if err != nil {
+		s.forwardError(w, r, nil, err)
+		return
+	}
+
+	p, err := s.d.SSOOIDCProviderRegistry().Get(ctx, providerID)
+	if err != nil {
+		s.forwardError(w, r, nil, err)
+		return
+	}
+
+	token, err := p.OAuth2Config.Exchange(ctx, r.URL.Query().Get("code"), oauth2.VerifierOption(verifier))
+	if err != nil {
+		s.forwardError(w, r, nil, errors.Wrap(err, "sso_oidc: unable to exchange authorization code"))
+		return
+	}
+
+	rawIDToken, ok := token.Extra("id_token").(string)
+	if !ok {
+		s.forwardError(w, r, nil, errors.New("sso_oidc: token response did not contain an id_token"))
+		return
+	}
+
+	idToken, err := p.Verifier.Verify(ctx, rawIDToken)
+	if err != nil {
+		s.forwardError(w, r, nil, errors.Wrap(err, "sso_oidc: unable to verify id_token"))
+		return
+	}
+
+	var rawClaims map[string]interface{}
+	if err := idToken.Claims(&rawClaims); err != nil {
+		s.forwardError(w, r, nil, errors.Wrap(err, "sso_oidc: unable to decode id_token claims"))
+		return
+	}
+
+	claims, err := s.mapClaims(ctx, providerID, rawClaims)
+	if err != nil {
+		s.forwardError(w, r, nil, err)
+		return
+	}
+
+	if ff, err := s.processLoginOrRegister(w, r, flowID, providerID, claims); err != nil {
+		if ff != nil {
+			s.forwardError(w, r, *ff, err)
+			return
+		}
+		s.forwardError(w, r, nil, err)
+	}
+}
+
+// recoverPKCEState reads back the code verifier and originating flow ID the flow
+// handler's browser endpoint stashed in a state-keyed cookie, and confirms the verifier
+// was minted for this provider.
+func (s *Strategy) recoverPKCEState(r *http.Request, providerID, state string) (verifier, flowID string, err error) {
+	cookie, err := r.Cookie("ory_kratos_sso_oidc_pkce_" + state)
+	if err != nil {
+		return "", "", errors.Wrap(err, "sso_oidc: missing or expired PKCE state")
+	}
+
+	parts := strings.SplitN(cookie.Value, "|", 3)
+	if len(parts) != 3 || parts[0] != providerID {
+		return "", "", errors.New("sso_oidc: PKCE state does not match provider")
+	}
+
+	return parts[1], parts[2], nil
+}
+
+// mapClaims fetches the provider's configured Jsonnet mapper and runs it against the ID
+// token's raw claims, the same claims-to-traits convention the saml strategy's
+// provider.Claims uses for SAML attributes, producing the traits to apply to the
+// identity plus the subject used to correlate this login to one.
+func (s *Strategy) mapClaims(ctx context.Context, providerID string, rawClaims map[string]interface{}) (*Claims, error) {
+	conf, err := s.d.SSOOIDCProviderRegistry().Configuration(ctx, providerID)
+	if err != nil {
+		return nil, err
+	}
+
+	if conf.MapperURL == "" {
+		return nil, errors.Errorf("sso_oidc: provider %q has no mapper_url configured", providerID)
+	}
+
+	mapperSource, err := s.f.Fetch(conf.MapperURL)
+	if err != nil {
+		return nil, errors.Wrapf(err, "sso_oidc: unable to fetch claims mapper for provider %q", providerID)
+	}
+
+	rawClaimsJSON, err := json.Marshal(rawClaims)
+	if err != nil {
+		return nil, errors.Wrap(err, "sso_oidc: unable to marshal id_token claims")
+	}
+
+	vm := jsonnet.MakeVM()
+	vm.ExtCode("claims", string(rawClaimsJSON))
+
+	out, err := vm.EvaluateAnonymousSnippet(conf.MapperURL, mapperSource.String())
+	if err != nil {
+		return nil, errors.Wrapf(err, "sso_oidc: claims mapper for provider %q failed", providerID)
+	}
+
+	var mapped struct {
+		Identity struct {
+			Traits json.RawMessage `json:"traits"`
+		} `json:"identity"`
+	}
+	if err := json.Unmarshal([]byte(out), &mapped); err != nil {
+		return nil, errors.Wrapf(err, "sso_oidc: claims mapper for provider %q returned invalid output", providerID)
+	}
+
+	subject, _ := rawClaims["sub"].(string)
+	if subject == "" {
+		return nil, errors.Errorf("sso_oidc: id_token for provider %q did not contain a sub claim", providerID)
+	}
+
+	return &Claims{Subject: subject, Traits: mapped.Identity.Traits}, nil
+}
+
+// validateFlow looks up the login or registration flow the OIDC callback belongs to,
+// mirroring the saml strategy's validateFlow.
+func (s *Strategy) validateFlow(ctx context.Context, rid uuid.UUID) (flow.Flow, error) {
+	if x.IsZeroUUID(rid) {
+		return nil, errors.WithStack(herodot.ErrBadRequest.WithReason("The OIDC callback is missing the flow it belongs to. Please restart the flow."))
+	}
+
+	if lf, err := s.d.LoginFlowPersister().GetLoginFlow(ctx, rid); err == nil {
+		return lf, nil
+	}
+
+	if rf, err := s.d.RegistrationFlowPersister().GetRegistrationFlow(ctx, rid); err == nil {
+		return rf, nil
+	}
+
+	return nil, errors.WithStack(herodot.ErrNotFound.WithReason("The flow referenced by the OIDC callback could not be found. Please restart the flow."))
+}
+
+// processLoginOrRegister links the verified OIDC identity to an existing Kratos
+// identity and completes the login flow, or - if no identity is linked to this
+// provider/subject pair yet - completes the originating registration flow with the
+// mapped traits. This is the OIDC analogue of the saml strategy's processLoginOrRegister.
+func (s *Strategy) processLoginOrRegister(w http.ResponseWriter, r *http.Request, flowID, providerID string, claims *Claims) (*flow.Flow, error) {
+	ctx := r.Context()
+
+	f, err := s.validateFlow(ctx, x.ParseUUID(flowID))
+	if err != nil {
+		return nil, err
+	}
+
+	i, _, err := s.d.PrivilegedIdentityPool().FindByCredentialsIdentifier(ctx, s.ID(), uid(providerID, claims.Subject))
+	if err != nil {
+		return &f, s.processRegistration(w, r, f, providerID, claims)
+	}
+
+	return &f, s.processLogin(w, r, f, i)
+}
+
+func (s *Strategy) processLogin(w http.ResponseWriter, r *http.Request, f flow.Flow, i *identity.Identity) error {
+	lf, ok := f.(*login.Flow)
+	if !ok {
+		return errors.WithStack(herodot.ErrBadRequest.WithReason("An OIDC account is already linked, but the originating flow is not a login flow."))
+	}
+
+	return s.d.LoginHookExecutor().PostLoginHook(w, r, s.NodeGroup(), lf, i, s.ID().String())
+}
+
+func (s *Strategy) processRegistration(w http.ResponseWriter, r *http.Request, f flow.Flow, providerID string, claims *Claims) error {
+	rf, ok := f.(*registration.Flow)
+	if !ok {
+		return errors.WithStack(herodot.ErrBadRequest.WithReason("No identity is linked to this OIDC account yet, and the originating flow is not a registration flow."))
+	}
+
+	i := identity.NewIdentity(s.d.Config(r.Context()).DefaultIdentityTraitsSchemaID())
+	i.Traits = identity.Traits(claims.Traits)
+	i.SetCredentials(s.ID(), identity.Credentials{
+		Type:        s.ID(),
+		Identifiers: []string{uid(providerID, claims.Subject)},
+		Config:      json.RawMessage(`{}`),
+	})
+
+	return s.d.RegistrationHookExecutor().PostRegistrationHook(w, r, s.NodeGroup(), rf, i)
+}
+
+func uid(providerID, subject string) string {
+	return providerID + ":" + subject
+}
+
+func (s *Strategy) forwardError(w http.ResponseWriter, r *http.Request, f flow.Flow, err error) {
+	switch ff := f.(type) {
+	case *login.Flow:
+		s.d.LoginFlowErrorHandler().WriteFlowError(w, r, ff, s.NodeGroup(), err)
+	case *registration.Flow:
+		s.d.RegistrationFlowErrorHandler().WriteFlowError(w, r, ff, s.NodeGroup(), err)
+	default:
+		s.d.LoginFlowErrorHandler().WriteFlowError(w, r, nil, s.NodeGroup(), err)
+	}
+}